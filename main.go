@@ -5,7 +5,7 @@
 // Go-import-redirector is an HTTP server for a custom Go import domain.
 // It responds to requests in a given import path root with a meta tag
 // specifying the source repository for the ``go get'' command and an
-// HTML redirect to the godoc.org documentation page for that package.
+// HTML redirect to the pkg.go.dev documentation page for that package.
 //
 // Usage:
 //
@@ -15,7 +15,7 @@
 // and responds to requests for URLs in the given import path root
 // with one meta tag specifying the given source repository for ``go get''
 // and another meta tag causing a redirect to the corresponding
-// godoc.org documentation page.
+// pkg.go.dev documentation page.
 //
 // For example, if invoked as:
 //
@@ -24,7 +24,7 @@
 // then the response for 9fans.net/go/acme/editinacme will include these tags:
 //
 //	<meta name="go-import" content="9fans.net/go git https://github.com/9fans/go">
-//	<meta http-equiv="refresh" content="0; url=https://godoc.org/9fans.net/go/acme/editinacme">
+//	<meta http-equiv="refresh" content="0; url=https://pkg.go.dev/9fans.net/go/acme/editinacme">
 //
 // If both <import> and <repo> end in /*, the corresponding path element
 // is taken from the import path and substituted in repo on each request.
@@ -35,7 +35,7 @@
 // then the response for rsc.io/x86/x86asm will include these tags:
 //
 //	<meta name="go-import" content="rsc.io/x86 git https://github.com/rsc/x86">
-//	<meta http-equiv="refresh" content="0; url=https://godoc.org/rsc.io/x86/x86asm">
+//	<meta http-equiv="refresh" content="0; url=https://pkg.go.dev/rsc.io/x86/x86asm">
 //
 // Note that the wildcard element (x86) has been included in the Git repo path.
 //
@@ -47,8 +47,27 @@
 // (for example, rsc.io.crt and rsc.io.key).
 // Like for http.ListenAndServeTLS, the certificate file should contain the
 // concatenation of the server's certificate and the signing certificate authority's certificate.
+// With -tls, go-import-redirector also binds a plain HTTP listener (-http-addr,
+// default ``:http'') that answers ACME http-01 challenges and 301-redirects
+// everything else to the https equivalent; pass -https-only to skip this and
+// serve HTTPS alone, as before.
 //
-// The -vcs option specifies the version control system, git, hg, or svn (default ``git'').
+// The -vcs option specifies the version control system, git, hg, or svn
+// (default ``git''), used as the default for modules that don't set their
+// own VCS in the config file, and documentation links point at pkg.go.dev
+// unless overridden by Config.DocsBase or a per-module ModConfig.DocsBase.
+//
+// The -log-format option selects the access log format written for every
+// request: text (default), json, or apache (combined log format, plus a
+// trailing repo field). A Prometheus metrics endpoint is always served at
+// /.metrics, with a redirects_total counter and a redirect_latency_seconds
+// histogram, both labeled by import_root and the resolved repo.
+//
+// If started under an init system that performs systemd-style socket
+// activation (LISTEN_PID and LISTEN_FDS set in the environment),
+// go-import-redirector serves on the inherited file descriptors instead of
+// binding -addr itself, which allows unprivileged binds to ports 80 and 443
+// and restarts without dropping in-flight connections.
 //
 // Deployment on Google Cloud Platform
 //
@@ -61,32 +80,57 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 type Config struct {
-	Modules []ModConfig
+	DocsBase string
+	Modules  []ModConfig
 }
 
 type ModConfig struct {
 	ImportPath string
 	RepoPath   string
+	Home       string
+	Directory  string
+	File       string
+	VCS        string
+	DocsBase   string
+	Subpath    []SubpathConfig
+}
+
+// SubpathConfig routes one sub-path of an import root to a repo of its own,
+// for import domains that don't share a single owner or host.
+type SubpathConfig struct {
+	Name     string
+	RepoPath string
+	VCS      string
 }
 
 type mod struct {
 	importPath string
 	repoPath   string
 	wildcard   bool
+	home       string
+	directory  string
+	file       string
+	vcs        string
+	docsBase   string
+	subpaths   map[string]mod
 }
 
 type modSlice []mod
@@ -105,10 +149,13 @@ func (ms modSlice) Swap(i, j int) {
 
 var (
 	addr             = flag.String("addr", ":http", "serve http on `address`")
+	httpAddr         = flag.String("http-addr", ":http", "serve the http->https redirect on `address` (only with -tls)")
+	httpsOnly        = flag.Bool("https-only", false, "with -tls, serve only https and skip the http->https redirect listener")
 	serveTLS         = flag.Bool("tls", false, "serve https on :443")
 	vcs              = flag.String("vcs", "git", "set version control `system`")
 	letsEncryptEmail = flag.String("letsencrypt", "", "use lets encrypt to issue TLS certificate, agreeing to TOS as `email` (implies -tls)")
 	configFile       = flag.String("config", "", "configuration file")
+	logFormat        = flag.String("log-format", "text", "access log `format`: text, json, or apache")
 	mods             = modSlice{}
 	hosts            = map[string]struct{}{}
 )
@@ -129,13 +176,15 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
+	http.HandleFunc("/.metrics", metricsHandler)
+
 	if flag.NArg()%2 != 0 {
 		flag.Usage()
 	}
 	for idx := 0; idx < flag.NArg(); idx += 2 {
 		importPath := flag.Arg(idx)
 		repoPath := flag.Arg(idx + 1)
-		parseModulePairAndRegister(importPath, repoPath, *serveTLS)
+		parseModulePairAndRegister(ModConfig{ImportPath: importPath, RepoPath: repoPath}, defaultDocsBase, *serveTLS)
 	}
 
 	cfg := Config{}
@@ -143,8 +192,12 @@ func main() {
 		if _, err := toml.DecodeFile(*configFile, &cfg); err != nil {
 			log.Fatalf("Failed to parse config file, %s", err)
 		}
-		for _, mod := range cfg.Modules {
-			parseModulePairAndRegister(mod.ImportPath, mod.RepoPath, *serveTLS)
+		docsBase := cfg.DocsBase
+		if docsBase == "" {
+			docsBase = defaultDocsBase
+		}
+		for _, mc := range cfg.Modules {
+			parseModulePairAndRegister(mc, docsBase, *serveTLS)
 		}
 	}
 
@@ -153,18 +206,117 @@ func main() {
 	}
 	sort.Sort(mods)
 
+	fds := listenFDs()
+
 	if !*serveTLS {
-		log.Fatal(http.ListenAndServe(*addr, nil))
+		ln := httpListener(fds, 0, *addr)
+		closeUnusedFDs(fds, 1)
+		log.Fatal(http.Serve(ln, nil))
 	}
 
 	var uniqHosts []string
 	for host := range hosts {
 		uniqHosts = append(uniqHosts, host)
 	}
-	log.Fatal(http.Serve(autocert.NewListener(uniqHosts...), nil))
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(uniqHosts...),
+	}
+
+	if *httpsOnly {
+		httpsLn := httpListener(fds, 0, ":https")
+		closeUnusedFDs(fds, 1)
+		log.Fatal(http.Serve(tls.NewListener(httpsLn, m.TLSConfig()), nil))
+	}
+
+	httpLn := httpListener(fds, 0, *httpAddr)
+	httpsLn := httpListener(fds, 1, ":https")
+	closeUnusedFDs(fds, 2)
+	go http.Serve(httpLn, m.HTTPHandler(httpsRedirectHandler()))
+	log.Fatal(http.Serve(tls.NewListener(httpsLn, m.TLSConfig()), nil))
+}
+
+// closeUnusedFDs closes any socket-activated listeners beyond the first
+// used of them, so a unit that hands down more fds than the selected
+// serving mode consumes doesn't leave sockets open with nothing accepting
+// on them.
+func closeUnusedFDs(fds []net.Listener, used int) {
+	if used > len(fds) {
+		used = len(fds)
+	}
+	for _, ln := range fds[used:] {
+		if err := ln.Close(); err != nil {
+			log.Printf("socket activation: closing unused listener: %v", err)
+		}
+	}
+}
+
+// httpsRedirectHandler 301-redirects everything to the https equivalent of
+// the request, for the plain-HTTP listener that autocert's HTTPHandler
+// falls back to once it's determined a request isn't an ACME http-01
+// challenge.
+func httpsRedirectHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		target := "https://" + req.Host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+	}
+}
+
+// httpListener returns fds[idx] if socket activation supplied enough
+// listeners, otherwise it falls back to binding addr itself.
+func httpListener(fds []net.Listener, idx int, addr string) net.Listener {
+	if idx < len(fds) {
+		return fds[idx]
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ln
+}
+
+// listenFDs returns the listeners passed down by an init system via
+// systemd-style socket activation (LISTEN_PID/LISTEN_FDS), or nil if the
+// process wasn't socket-activated. This lets go-import-redirector bind
+// privileged ports like 80/443 without running as root and restart without
+// dropping in-flight connections.
+func listenFDs() []net.Listener {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds == 0 {
+		return nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	listeners := make([]net.Listener, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("socket activation: fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners
 }
 
-func parseModulePairAndRegister(importPath, repoPath string, parseHost bool) {
+// listenFDsStart is the first file descriptor systemd hands to an
+// activated process; fds 0-2 remain stdin/stdout/stderr.
+const listenFDsStart = 3
+
+// defaultDocsBase is the documentation site linked to when neither the
+// top-level Config.DocsBase nor a per-module ModConfig.DocsBase is set.
+const defaultDocsBase = "https://pkg.go.dev/"
+
+func parseModulePairAndRegister(mc ModConfig, docsBase string, parseHost bool) {
+	importPath, repoPath := mc.ImportPath, mc.RepoPath
 	wildcard := false
 
 	if !strings.Contains(repoPath, "://") {
@@ -178,13 +330,66 @@ func parseModulePairAndRegister(importPath, repoPath string, parseHost bool) {
 		importPath = strings.TrimSuffix(importPath, "/*")
 		repoPath = strings.TrimSuffix(repoPath, "/*")
 	}
+
+	// Default each go-source field independently: an operator who only
+	// overrides Directory/File (e.g. a non-master branch) shouldn't lose
+	// Home, and vice versa. For a host defaultGoSource doesn't recognize
+	// there are no defaults, so any field left unset stays empty.
+	home, directory, file := mc.Home, mc.Directory, mc.File
+	defaultHome, defaultDirectory, defaultFile := defaultGoSource(repoPath)
+	if home == "" {
+		home = defaultHome
+	}
+	if directory == "" {
+		directory = defaultDirectory
+	}
+	if file == "" {
+		file = defaultFile
+	}
+
+	modVCS := mc.VCS
+	if modVCS == "" {
+		modVCS = *vcs
+	}
+	modDocsBase := mc.DocsBase
+	if modDocsBase == "" {
+		modDocsBase = docsBase
+	}
+
+	var subpaths map[string]mod
+	for _, sc := range mc.Subpath {
+		subVCS := sc.VCS
+		if subVCS == "" {
+			subVCS = modVCS
+		}
+		subHome, subDirectory, subFile := defaultGoSource(sc.RepoPath)
+		if subpaths == nil {
+			subpaths = map[string]mod{}
+		}
+		subpaths[sc.Name] = mod{
+			importPath: importPath + "/" + sc.Name,
+			repoPath:   sc.RepoPath,
+			vcs:        subVCS,
+			docsBase:   modDocsBase,
+			home:       subHome,
+			directory:  subDirectory,
+			file:       subFile,
+		}
+	}
+
 	mods = append(mods, mod{
 		importPath: importPath,
 		repoPath:   repoPath,
 		wildcard:   wildcard,
+		home:       home,
+		directory:  directory,
+		file:       file,
+		vcs:        modVCS,
+		docsBase:   modDocsBase,
+		subpaths:   subpaths,
 	})
-	http.HandleFunc(strings.TrimSuffix(importPath, "/")+"/", redirect)
-	http.HandleFunc(importPath+"/.ping", pong) // non-redirecting URL for debugging TLS certificates
+	http.HandleFunc(strings.TrimSuffix(importPath, "/")+"/", withAccessLog(importPath, redirect))
+	http.HandleFunc(importPath+"/.ping", withAccessLog(importPath, pong)) // non-redirecting URL for debugging TLS certificates
 	if !parseHost {
 		return
 	}
@@ -195,31 +400,48 @@ func parseModulePairAndRegister(importPath, repoPath string, parseHost bool) {
 	hosts[host] = struct{}{}
 }
 
+// defaultGoSource derives go-source home/directory/file templates from repoPath
+// for the common github.com and gitlab.com hosting layouts. Repos hosted
+// elsewhere get no default, since the URL layout can't be guessed; set
+// ModConfig.Home/Directory/File explicitly in that case.
+func defaultGoSource(repoPath string) (home, directory, file string) {
+	if !strings.Contains(repoPath, "github.com/") && !strings.Contains(repoPath, "gitlab.com/") {
+		return "", "", ""
+	}
+	home = "{repo}"
+	directory = "{repo}/tree/master{/dir}"
+	file = "{repo}/blob/master{/dir}/{file}#L{line}"
+	return
+}
+
 var tmpl = template.Must(template.New("main").Parse(`<!DOCTYPE html>
 <html>
 <head>
 <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
 <meta name="go-import" content="{{.ImportRoot}} {{.VCS}} {{.VCSRoot}}">
-<meta http-equiv="refresh" content="0; url=https://godoc.org/{{.ImportRoot}}{{.Suffix}}">
+{{if or .GoSourceHome .GoSourceDirectory .GoSourceFile}}<meta name="go-source" content="{{.ImportRoot}} {{.GoSourceHome}} {{.GoSourceDirectory}} {{.GoSourceFile}}">
+{{end}}<meta http-equiv="refresh" content="0; url={{.DocsBase}}{{.ImportRoot}}{{.Suffix}}">
 </head>
 <body>
-Redirecting to docs at <a href="https://godoc.org/{{.ImportRoot}}{{.Suffix}}">godoc.org/{{.ImportRoot}}{{.Suffix}}</a>...
+Redirecting to docs at <a href="{{.DocsBase}}{{.ImportRoot}}{{.Suffix}}">{{.DocsBase}}{{.ImportRoot}}{{.Suffix}}</a>...
 </body>
 </html>
 `))
 
 type data struct {
-	ImportRoot string
-	VCS        string
-	VCSRoot    string
-	Suffix     string
+	ImportRoot        string
+	VCS               string
+	VCSRoot           string
+	Suffix            string
+	DocsBase          string
+	GoSourceHome      string
+	GoSourceDirectory string
+	GoSourceFile      string
 }
 
 func redirect(w http.ResponseWriter, req *http.Request) {
 	path := strings.TrimSuffix(req.Host+req.URL.Path, "/")
-	d := &data{
-		VCS: *vcs,
-	}
+	d := &data{}
 	for _, m := range mods {
 		if m.redirect(path, d) {
 			break
@@ -229,6 +451,9 @@ func redirect(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	if sw, ok := w.(*statusWriter); ok {
+		sw.setResolved(d.ImportRoot, d.VCSRoot)
+	}
 	var buf bytes.Buffer
 	err := tmpl.Execute(&buf, d)
 	if err != nil {
@@ -242,6 +467,17 @@ func (m *mod) redirect(path string, d *data) bool {
 	if path != m.importPath && !strings.HasPrefix(path, m.importPath+"/") {
 		return false
 	}
+	if len(m.subpaths) > 0 && path != m.importPath {
+		elem := path[len(m.importPath)+1:]
+		if i := strings.Index(elem, "/"); i >= 0 {
+			elem = elem[:i]
+		}
+		if sub, ok := m.subpaths[elem]; ok {
+			return sub.redirect(path, d)
+		}
+	}
+	d.VCS = m.vcs
+	d.DocsBase = m.docsBase
 	if m.wildcard {
 		if path == m.importPath {
 			return false
@@ -257,9 +493,33 @@ func (m *mod) redirect(path string, d *data) bool {
 		d.VCSRoot = m.repoPath
 		d.Suffix = path[len(m.importPath):]
 	}
+	d.GoSourceHome = m.goSource(m.home, d)
+	d.GoSourceDirectory = m.goSource(m.directory, d)
+	d.GoSourceFile = m.goSource(m.file, d)
+	if d.GoSourceHome != "" || d.GoSourceDirectory != "" || d.GoSourceFile != "" {
+		// go-source uses "_" to mean "no value for this field"; leaving one
+		// blank would emit a malformed, short-field tag instead.
+		for _, f := range []*string{&d.GoSourceHome, &d.GoSourceDirectory, &d.GoSourceFile} {
+			if *f == "" {
+				*f = "_"
+			}
+		}
+	}
 	return true
 }
 
+// goSource interpolates a go-source template with the request's resolved
+// repo root and directory suffix. {file} and {line} are left untouched;
+// gddo substitutes those itself when rendering a specific source file.
+func (m *mod) goSource(tmpl string, d *data) string {
+	if tmpl == "" {
+		return ""
+	}
+	tmpl = strings.Replace(tmpl, "{repo}", d.VCSRoot, -1)
+	tmpl = strings.Replace(tmpl, "{/dir}", d.Suffix, -1)
+	return tmpl
+}
+
 func pong(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "pong")
 }
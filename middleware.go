@@ -0,0 +1,231 @@
+// Copyright 2015 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusWriter wraps an http.ResponseWriter to capture the status code and
+// byte count written, httpsnoop-style, without breaking Hijack for callers
+// further down the chain. It also gives handlers a place to report the
+// import root and repo a request resolved to, since those are only known
+// once redirect() has run.
+type statusWriter struct {
+	http.ResponseWriter
+	status     int
+	bytes      int
+	importRoot string
+	repo       string
+}
+
+// setResolved records the specific import root and backend repo a request
+// resolved to (e.g. rsc.io/x86, not just the registered rsc.io prefix), so
+// withAccessLog can log and label metrics with them once the handler returns.
+func (w *statusWriter) setResolved(importRoot, repo string) {
+	w.importRoot = importRoot
+	w.repo = repo
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// withAccessLog wraps next with access logging and metrics collection.
+// importRoot is the import path prefix next was registered under; it's
+// used as the label only when next never resolves a more specific one
+// (e.g. a 404, or the .ping endpoint), since wildcard and subpath modules
+// otherwise report the per-request resolved import root via statusWriter.
+func withAccessLog(importRoot string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		resolvedRoot := sw.importRoot
+		if resolvedRoot == "" {
+			resolvedRoot = importRoot
+		}
+		latency := time.Since(start)
+		logAccess(req, resolvedRoot, sw.repo, sw.status, sw.bytes, latency)
+		metrics.observe(resolvedRoot, sw.repo, sw.status, latency)
+	}
+}
+
+func logAccess(req *http.Request, importRoot, repo string, status, bytes int, latency time.Duration) {
+	switch *logFormat {
+	case "json":
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"time":        time.Now().Format(time.RFC3339),
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"import_root": importRoot,
+			"repo":        repo,
+			"status":      status,
+			"bytes":       bytes,
+			"latency_ms":  float64(latency) / float64(time.Millisecond),
+		})
+	case "apache":
+		// Apache combined log format, plus a trailing repo=... field; tools
+		// that parse the standard combined fields can ignore the rest.
+		fmt.Printf("%s - - [%s] %q %d %d %q %q repo=%q\n",
+			req.RemoteAddr, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+			fmt.Sprintf("%s %s %s", req.Method, req.URL.RequestURI(), req.Proto), status, bytes,
+			req.Referer(), req.UserAgent(), repo)
+	default:
+		// req.URL.Path is attacker-controlled and net/http has already
+		// percent-decoded it, so it must be quoted before hitting the log
+		// stream or a crafted path can inject newlines/control characters.
+		// import_root and repo carry the wildcard path element, so they are
+		// quoted too.
+		log.Printf("%s %q import_root=%q repo=%q status=%d bytes=%d latency=%s",
+			req.Method, req.URL.Path, importRoot, repo, status, bytes, latency)
+	}
+}
+
+// latencyBucketsSec are the Prometheus histogram bucket boundaries, in
+// seconds, for redirect_latency_seconds.
+var latencyBucketsSec = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// repoLabels identifies a (import_root, repo) label pair shared by the
+// counter and histogram below.
+type repoLabels struct {
+	importRoot string
+	repo       string
+}
+
+// metricsRegistry accumulates Prometheus-style counters and a latency
+// histogram, both labeled by import root and resolved repo, for the
+// /.metrics endpoint.
+type metricsRegistry struct {
+	mu            sync.Mutex
+	redirects     map[repoLabels]map[string]int64 // labels -> status -> count
+	latencyCounts map[repoLabels][]int64          // labels -> cumulative bucket counts
+	latencySum    map[repoLabels]float64
+	latencyCount  map[repoLabels]int64
+}
+
+var metrics = &metricsRegistry{
+	redirects:     map[repoLabels]map[string]int64{},
+	latencyCounts: map[repoLabels][]int64{},
+	latencySum:    map[repoLabels]float64{},
+	latencyCount:  map[repoLabels]int64{},
+}
+
+func (m *metricsRegistry) observe(importRoot, repo string, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := repoLabels{importRoot: importRoot, repo: repo}
+
+	byStatus, ok := m.redirects[labels]
+	if !ok {
+		byStatus = map[string]int64{}
+		m.redirects[labels] = byStatus
+	}
+	byStatus[strconv.Itoa(status)]++
+
+	buckets, ok := m.latencyCounts[labels]
+	if !ok {
+		buckets = make([]int64, len(latencyBucketsSec))
+		m.latencyCounts[labels] = buckets
+	}
+	sec := latency.Seconds()
+	for i, le := range latencyBucketsSec {
+		if sec <= le {
+			buckets[i]++
+		}
+	}
+	m.latencySum[labels] += sec
+	m.latencyCount[labels]++
+}
+
+// sortedRepoLabels returns labels in a stable order so /.metrics output
+// doesn't jitter between scrapes.
+func sortedRepoLabels(labels map[repoLabels]struct{}) []repoLabels {
+	sorted := make([]repoLabels, 0, len(labels))
+	for l := range labels {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].importRoot != sorted[j].importRoot {
+			return sorted[i].importRoot < sorted[j].importRoot
+		}
+		return sorted[i].repo < sorted[j].repo
+	})
+	return sorted
+}
+
+// writeTo renders the registry in the Prometheus text exposition format.
+func (m *metricsRegistry) writeTo(w http.ResponseWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP redirects_total Total go-import redirects served.")
+	fmt.Fprintln(w, "# TYPE redirects_total counter")
+	labelSet := make(map[repoLabels]struct{}, len(m.redirects))
+	for l := range m.redirects {
+		labelSet[l] = struct{}{}
+	}
+	for _, l := range sortedRepoLabels(labelSet) {
+		statuses := make([]string, 0, len(m.redirects[l]))
+		for status := range m.redirects[l] {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "redirects_total{import_root=%q,repo=%q,status=%q} %d\n",
+				l.importRoot, l.repo, status, m.redirects[l][status])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP redirect_latency_seconds Latency of go-import redirect responses.")
+	fmt.Fprintln(w, "# TYPE redirect_latency_seconds histogram")
+	labelSet = make(map[repoLabels]struct{}, len(m.latencyCounts))
+	for l := range m.latencyCounts {
+		labelSet[l] = struct{}{}
+	}
+	for _, l := range sortedRepoLabels(labelSet) {
+		buckets := m.latencyCounts[l]
+		for i, le := range latencyBucketsSec {
+			fmt.Fprintf(w, "redirect_latency_seconds_bucket{import_root=%q,repo=%q,le=%q} %d\n",
+				l.importRoot, l.repo, strconv.FormatFloat(le, 'g', -1, 64), buckets[i])
+		}
+		fmt.Fprintf(w, "redirect_latency_seconds_bucket{import_root=%q,repo=%q,le=\"+Inf\"} %d\n", l.importRoot, l.repo, m.latencyCount[l])
+		fmt.Fprintf(w, "redirect_latency_seconds_sum{import_root=%q,repo=%q} %g\n", l.importRoot, l.repo, m.latencySum[l])
+		fmt.Fprintf(w, "redirect_latency_seconds_count{import_root=%q,repo=%q} %d\n", l.importRoot, l.repo, m.latencyCount[l])
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeTo(w)
+}